@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// maxAnnouncementSkew bounds how far a signed announcement's timestamp may
+// drift from the server's clock before it is rejected as a replay.
+const maxAnnouncementSkew = 60 * time.Second
+
+// loadClientTLSConfig builds the tls.Config used by notifyCloud's HTTP
+// client from a client certificate/key pair and an optional CA bundle used
+// to validate the cloud's server certificate. certFile and keyFile must
+// both be set or both be empty.
+func loadClientTLSConfig(certFile, keyFile, caBundleFile string) (*tls.Config, error) {
+	if len(certFile) == 0 && len(keyFile) == 0 && len(caBundleFile) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if len(certFile) != 0 || len(keyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(caBundleFile) != 0 {
+		pool, err := loadCertPool(caBundleFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// loadServerTLSConfig builds the tls.Config used by runServer's http.Server.
+// When clientCAFile is set, the server requires and verifies a client
+// certificate from every caller.
+func loadServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if len(certFile) == 0 && len(keyFile) == 0 && len(clientCAFile) == 0 {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if len(clientCAFile) != 0 {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// cloudHTTPClient builds the single *http.Client notifyCloud and outbox
+// retries should share for the lifetime of the process, configured with
+// mTLS when CLOUD_CLIENT_CERT/KEY/CA_BUNDLE are set, or http.DefaultClient
+// otherwise. Building it once lets TLS connections be reused across
+// announcements instead of being re-established on every call.
+func cloudHTTPClient(config *config) (*http.Client, error) {
+	tlsConfig, err := loadClientTLSConfig(config.cloudClientCert, config.cloudClientKey, config.cloudCABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		return http.DefaultClient, nil
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle '%s': %w", file, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates found in CA bundle '%s'", file)
+	}
+
+	return pool, nil
+}
+
+// signAnnouncement computes an HMAC-SHA256 signature over id|timestamp|nonce
+// using the cloud API key as the shared secret, hex-encoded.
+func signAnnouncement(apiKey, id string, timestamp int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	fmt.Fprintf(mac, "%s|%d|%s", id, timestamp, nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAnnouncementSignature reports whether signature is the expected
+// HMAC for id|timestamp|nonce under apiKey, and that timestamp falls within
+// maxAnnouncementSkew of now, so a captured announcement cannot be replayed
+// indefinitely.
+func verifyAnnouncementSignature(apiKey, id string, timestamp int64, nonce, signature string, now time.Time) bool {
+	expected := signAnnouncement(apiKey, id, timestamp, nonce)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+		return false
+	}
+
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+
+	return skew <= maxAnnouncementSkew
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignAndVerifyAnnouncement(t *testing.T) {
+	now := time.Now()
+	signature := signAnnouncement("secret", "cloud-1", now.Unix(), "nonce-1")
+
+	if !verifyAnnouncementSignature("secret", "cloud-1", now.Unix(), "nonce-1", signature, now) {
+		t.Fatal("expected freshly signed announcement to verify")
+	}
+}
+
+func TestVerifyAnnouncementSignatureRejectsWrongSecret(t *testing.T) {
+	now := time.Now()
+	signature := signAnnouncement("secret", "cloud-1", now.Unix(), "nonce-1")
+
+	if verifyAnnouncementSignature("other-secret", "cloud-1", now.Unix(), "nonce-1", signature, now) {
+		t.Fatal("expected verification to fail with the wrong secret")
+	}
+}
+
+func TestVerifyAnnouncementSignatureRejectsTamperedFields(t *testing.T) {
+	now := time.Now()
+	signature := signAnnouncement("secret", "cloud-1", now.Unix(), "nonce-1")
+
+	if verifyAnnouncementSignature("secret", "cloud-2", now.Unix(), "nonce-1", signature, now) {
+		t.Fatal("expected verification to fail when id is tampered with")
+	}
+
+	if verifyAnnouncementSignature("secret", "cloud-1", now.Unix(), "nonce-2", signature, now) {
+		t.Fatal("expected verification to fail when nonce is tampered with")
+	}
+}
+
+func TestVerifyAnnouncementSignatureSkewWindow(t *testing.T) {
+	now := time.Now()
+	timestamp := now.Unix()
+	signature := signAnnouncement("secret", "cloud-1", timestamp, "nonce-1")
+
+	withinSkew := now.Add(maxAnnouncementSkew - time.Second)
+	if !verifyAnnouncementSignature("secret", "cloud-1", timestamp, "nonce-1", signature, withinSkew) {
+		t.Fatal("expected a timestamp just inside the skew window to verify")
+	}
+
+	beyondSkew := now.Add(maxAnnouncementSkew + time.Second)
+	if verifyAnnouncementSignature("secret", "cloud-1", timestamp, "nonce-1", signature, beyondSkew) {
+		t.Fatal("expected a timestamp beyond the skew window to be rejected as a replay")
+	}
+
+	beforeSkew := now.Add(-(maxAnnouncementSkew + time.Second))
+	if verifyAnnouncementSignature("secret", "cloud-1", timestamp, "nonce-1", signature, beforeSkew) {
+		t.Fatal("expected a timestamp from before the skew window to be rejected")
+	}
+}
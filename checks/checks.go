@@ -0,0 +1,344 @@
+// Package checks runs the pluggable repeater checks (TCP dial, HTTP GET,
+// DNS lookup, ICMP ping, exec command) described by a CHECKS_CONFIG file.
+package checks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultCheckTimeout is used for any checkSpec that doesn't set its own
+// Timeout.
+const defaultCheckTimeout = 5 * time.Second
+
+// defaultCheckConcurrency bounds how many checks run at once when a
+// checksConfig doesn't set MaxConcurrency.
+const defaultCheckConcurrency = 5
+
+// Result is the structured outcome of running a single Check, as surfaced
+// in the /health response.
+type Result struct {
+	Name      string `json:"name"`
+	Ok        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Err       string `json:"err,omitempty"`
+}
+
+// Check is implemented by every repeater check type (TCP dial, HTTP GET,
+// DNS lookup, ICMP ping, exec command).
+type Check interface {
+	Name() string
+	Run(ctx context.Context) Result
+}
+
+// checkSpec is one entry of a CHECKS_CONFIG file, in YAML or JSON.
+type checkSpec struct {
+	Name     string   `yaml:"name" json:"name"`
+	Type     string   `yaml:"type" json:"type"`
+	Target   string   `yaml:"target" json:"target"`
+	Status   int      `yaml:"status" json:"status"`
+	Command  string   `yaml:"command" json:"command"`
+	Args     []string `yaml:"args" json:"args"`
+	Timeout  duration `yaml:"timeout" json:"timeout"`
+	Required bool     `yaml:"required" json:"required"`
+}
+
+// duration lets checkSpec.Timeout be written as a Go duration string
+// ("5s") in the CHECKS_CONFIG file instead of raw nanoseconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+// checksConfig is the top-level shape of a CHECKS_CONFIG file.
+type checksConfig struct {
+	Checks         []checkSpec `yaml:"checks" json:"checks"`
+	MaxConcurrency int         `yaml:"max_concurrency" json:"max_concurrency"`
+}
+
+// configuredCheck pairs a Check with whether its failure should fail
+// overall /health, since Check itself carries no such notion.
+type configuredCheck struct {
+	check    Check
+	required bool
+}
+
+// Runner holds the checks loaded from CHECKS_CONFIG and runs them
+// concurrently, bounded by maxConcurrency.
+type Runner struct {
+	checks         []configuredCheck
+	maxConcurrency int
+}
+
+// Load reads and parses path (YAML unless it ends in .json) and builds the
+// Check implementations it describes. An empty path disables the
+// subsystem; the returned Runner then has no checks and never fails
+// /health.
+func Load(path string) (*Runner, error) {
+	if len(path) == 0 {
+		return &Runner{maxConcurrency: defaultCheckConcurrency}, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checks config '%s': %w", path, err)
+	}
+
+	var parsed checksConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(raw, &parsed)
+	} else {
+		err = yaml.Unmarshal(raw, &parsed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checks config '%s': %w", path, err)
+	}
+
+	runner := &Runner{maxConcurrency: parsed.MaxConcurrency}
+	if runner.maxConcurrency <= 0 {
+		runner.maxConcurrency = defaultCheckConcurrency
+	}
+
+	for _, spec := range parsed.Checks {
+		check, err := buildCheck(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		runner.checks = append(runner.checks, configuredCheck{check: check, required: spec.Required})
+	}
+
+	return runner, nil
+}
+
+func buildCheck(spec checkSpec) (Check, error) {
+	timeout := time.Duration(spec.Timeout)
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+
+	switch spec.Type {
+	case "tcp":
+		return &tcpCheck{name: spec.Name, target: spec.Target, timeout: timeout}, nil
+	case "http":
+		expectedStatus := spec.Status
+		if expectedStatus == 0 {
+			expectedStatus = http.StatusOK
+		}
+		return &httpCheck{name: spec.Name, url: spec.Target, expectedStatus: expectedStatus, timeout: timeout}, nil
+	case "dns":
+		return &dnsCheck{name: spec.Name, host: spec.Target, timeout: timeout}, nil
+	case "icmp":
+		return &icmpCheck{name: spec.Name, host: spec.Target, timeout: timeout}, nil
+	case "exec":
+		return &execCheck{name: spec.Name, command: spec.Command, args: spec.Args, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown check type '%s' for check '%s'", spec.Type, spec.Name)
+	}
+}
+
+// Run executes every configured check concurrently (bounded by
+// maxConcurrency), and reports whether every required check passed.
+func (r *Runner) Run(ctx context.Context) ([]Result, bool) {
+	results := make([]Result, len(r.checks))
+	failedRequired := make([]bool, len(r.checks))
+
+	semaphore := make(chan struct{}, r.maxConcurrency)
+	done := make(chan int, len(r.checks))
+
+	for i, configured := range r.checks {
+		i, configured := i, configured
+		go func() {
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			results[i] = runOne(ctx, configured.check)
+			failedRequired[i] = configured.required && !results[i].Ok
+			done <- i
+		}()
+	}
+
+	for range r.checks {
+		<-done
+	}
+
+	ok := true
+	for _, failed := range failedRequired {
+		if failed {
+			ok = false
+		}
+	}
+
+	return results, ok
+}
+
+func runOne(ctx context.Context, check Check) Result {
+	start := time.Now()
+	result := check.Run(ctx)
+	result.Name = check.Name()
+	result.LatencyMs = time.Since(start).Milliseconds()
+	return result
+}
+
+// tcpCheck reports whether a TCP connection to target can be established.
+type tcpCheck struct {
+	name    string
+	target  string
+	timeout time.Duration
+}
+
+func (c *tcpCheck) Name() string { return c.name }
+
+func (c *tcpCheck) Run(ctx context.Context) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.target)
+	if err != nil {
+		return Result{Ok: false, Err: err.Error()}
+	}
+
+	conn.Close()
+	return Result{Ok: true}
+}
+
+// httpCheck reports whether a GET against url returns expectedStatus.
+type httpCheck struct {
+	name           string
+	url            string
+	expectedStatus int
+	timeout        time.Duration
+}
+
+func (c *httpCheck) Name() string { return c.name }
+
+func (c *httpCheck) Run(ctx context.Context) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return Result{Ok: false, Err: err.Error()}
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return Result{Ok: false, Err: err.Error()}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != c.expectedStatus {
+		return Result{Ok: false, Err: fmt.Sprintf("expected status %d, got %d", c.expectedStatus, response.StatusCode)}
+	}
+
+	return Result{Ok: true}
+}
+
+// dnsCheck reports whether host resolves to at least one address.
+type dnsCheck struct {
+	name    string
+	host    string
+	timeout time.Duration
+}
+
+func (c *dnsCheck) Name() string { return c.name }
+
+func (c *dnsCheck) Run(ctx context.Context) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, c.host)
+	if err != nil {
+		return Result{Ok: false, Err: err.Error()}
+	}
+
+	if len(addrs) == 0 {
+		return Result{Ok: false, Err: "no addresses returned"}
+	}
+
+	return Result{Ok: true}
+}
+
+// icmpCheck reports whether host answers a single ping, shelling out to
+// the system ping binary since an unprivileged raw ICMP socket isn't
+// available everywhere this agent runs.
+type icmpCheck struct {
+	name    string
+	host    string
+	timeout time.Duration
+}
+
+func (c *icmpCheck) Name() string { return c.name }
+
+func (c *icmpCheck) Run(ctx context.Context) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	timeoutSeconds := fmt.Sprintf("%d", int(c.timeout.Seconds()))
+	cmd := exec.CommandContext(ctx, "ping", "-c", "1", "-W", timeoutSeconds, c.host)
+	if err := cmd.Run(); err != nil {
+		return Result{Ok: false, Err: err.Error()}
+	}
+
+	return Result{Ok: true}
+}
+
+// execCheck reports whether an arbitrary command exits zero.
+type execCheck struct {
+	name    string
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+func (c *execCheck) Name() string { return c.name }
+
+func (c *execCheck) Run(ctx context.Context) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.command, c.args...)
+	if err := cmd.Run(); err != nil {
+		return Result{Ok: false, Err: err.Error()}
+	}
+
+	return Result{Ok: true}
+}
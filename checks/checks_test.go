@@ -0,0 +1,146 @@
+package checks
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock lets a test control exactly when a blockingCheck's Run call
+// returns, instead of relying on real time.Sleep, so concurrency tests are
+// deterministic.
+type fakeClock struct {
+	advance chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{advance: make(chan struct{})}
+}
+
+func (c *fakeClock) tick() {
+	close(c.advance)
+}
+
+// blockingCheck is a Check whose Run blocks until the fakeClock ticks or
+// ctx is done, incrementing running/peak counters so tests can observe how
+// many checks are in flight at once.
+type blockingCheck struct {
+	name    string
+	clock   *fakeClock
+	running *atomic.Int32
+	peak    *atomic.Int32
+}
+
+func (c *blockingCheck) Name() string { return c.name }
+
+func (c *blockingCheck) Run(ctx context.Context) Result {
+	n := c.running.Add(1)
+	defer c.running.Add(-1)
+
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+
+	select {
+	case <-c.clock.advance:
+		return Result{Ok: true}
+	case <-ctx.Done():
+		return Result{Ok: false, Err: ctx.Err().Error()}
+	}
+}
+
+func TestCheckRunnerRespectsMaxConcurrency(t *testing.T) {
+	clock := newFakeClock()
+	var running, peak atomic.Int32
+
+	const (
+		numChecks      = 8
+		maxConcurrency = 3
+	)
+
+	runner := &Runner{maxConcurrency: maxConcurrency}
+	for i := 0; i < numChecks; i++ {
+		runner.checks = append(runner.checks, configuredCheck{
+			check: &blockingCheck{name: "check", clock: clock, running: &running, peak: &peak},
+		})
+	}
+
+	resultsDone := make(chan []Result, 1)
+	go func() {
+		results, _ := runner.Run(context.Background())
+		resultsDone <- results
+	}()
+
+	// Give every worker goroutine a chance to start and block on the gate
+	// before releasing them, so peak reflects steady-state concurrency.
+	time.Sleep(20 * time.Millisecond)
+	clock.tick()
+
+	results := <-resultsDone
+	if len(results) != numChecks {
+		t.Fatalf("expected %d results, got %d", numChecks, len(results))
+	}
+
+	if got := peak.Load(); got > maxConcurrency {
+		t.Fatalf("expected at most %d checks running concurrently, saw %d", maxConcurrency, got)
+	}
+
+	for _, result := range results {
+		if !result.Ok {
+			t.Fatalf("expected every check to succeed once released, got %+v", result)
+		}
+	}
+}
+
+func TestCheckRunnerAggregatesRequiredFailures(t *testing.T) {
+	runner := &Runner{
+		maxConcurrency: defaultCheckConcurrency,
+		checks: []configuredCheck{
+			{check: &stubCheck{name: "ok", ok: true}, required: true},
+			{check: &stubCheck{name: "optional-fail", ok: false}, required: false},
+		},
+	}
+
+	results, ok := runner.Run(context.Background())
+	if !ok {
+		t.Fatal("expected overall result to be ok when only a non-required check fails")
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+
+	runner.checks = append(runner.checks, configuredCheck{check: &stubCheck{name: "required-fail", ok: false}, required: true})
+
+	_, ok = runner.Run(context.Background())
+	if ok {
+		t.Fatal("expected overall result to fail when a required check fails")
+	}
+}
+
+func TestTCPCheckRespectsCallerContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	check := &tcpCheck{name: "tcp", target: "127.0.0.1:1", timeout: time.Minute}
+
+	result := check.Run(ctx)
+	if result.Ok {
+		t.Fatal("expected the check to fail immediately against an already-canceled context")
+	}
+}
+
+// stubCheck is a Check that resolves immediately with a fixed result.
+type stubCheck struct {
+	name string
+	ok   bool
+}
+
+func (c *stubCheck) Name() string { return c.name }
+
+func (c *stubCheck) Run(ctx context.Context) Result {
+	return Result{Ok: c.ok}
+}
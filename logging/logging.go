@@ -0,0 +1,81 @@
+// Package logging builds the process-wide slog.Logger and the per-request
+// context fields layered on top of it.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// RequestIDHeader is the header callers may set to propagate their own
+// correlation ID; when absent, a new one is generated per request.
+const RequestIDHeader = "X-Request-ID"
+
+type loggerContextKey struct{}
+
+// NewInstanceID generates a random v4 UUID identifying this process for the
+// lifetime of the run.
+func NewInstanceID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// BaseLogger builds the process-wide logger with the context fields that
+// should appear on every log line.
+func BaseLogger(handler slog.Handler, cloudID, instanceID string) *slog.Logger {
+	return slog.New(handler).With(
+		"service", "agent",
+		"cloud_id", cloudID,
+		"instance_id", instanceID,
+	)
+}
+
+// NewLogHandler builds the slog.Handler for the given LOG_FORMAT ("json",
+// the default, or "text"), with a level that can be adjusted at runtime via
+// level.Set without rebuilding the handler.
+func NewLogHandler(format string, level slog.Leveler) slog.Handler {
+	options := &slog.HandlerOptions{Level: level}
+
+	if format == "text" {
+		return slog.NewTextHandler(os.Stderr, options)
+	}
+
+	return slog.NewJSONHandler(os.Stderr, options)
+}
+
+// WithRequest returns the per-request logger (carrying request_id) that
+// Middleware stashed in ctx, or logger unchanged when ctx holds none.
+func WithRequest(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if requestLogger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return requestLogger
+	}
+
+	return logger
+}
+
+// Middleware derives a per-request logger carrying a request_id (from the
+// X-Request-ID header, or freshly generated) and stashes it on the request
+// context for handlers to retrieve via WithRequest.
+func Middleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if len(requestID) == 0 {
+			requestID = NewInstanceID()
+		}
+
+		requestLogger := logger.With("request_id", requestID)
+		ctx := context.WithValue(r.Context(), loggerContextKey{}, requestLogger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -8,13 +8,15 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/is-my-homelab-up/agent/checks"
+	"github.com/is-my-homelab-up/agent/logging"
 )
 
 type config struct {
@@ -23,14 +25,34 @@ type config struct {
 	cloudUrl      string
 	cloudId       string
 	cloudApiKey   string
+	cloudMode     string
 	interval      time.Duration
 
 	serverAddress string
+
+	cloudClientCert string
+	cloudClientKey  string
+	cloudCABundle   string
+
+	serverTLSCert  string
+	serverTLSKey   string
+	serverClientCA string
+
+	outboxDir           string
+	outboxSweepInterval time.Duration
+	outboxMaxAge        time.Duration
+
+	checksConfigPath string
+
+	// cloudClient is the *http.Client used for every announcement to the
+	// cloud, built once in main so TLS connections are reused across ticks
+	// and outbox retries instead of being re-established per call.
+	cloudClient *http.Client
 }
 
 type HealthResponse struct {
-	Repeater string `json:"repeater"`
-	Id       string `json:"id"`
+	Id     string          `json:"id"`
+	Checks []checks.Result `json:"checks,omitempty"`
 }
 
 func getEnvVariable(name string, defaultValue string) (string, error) {
@@ -67,6 +89,11 @@ func parseConfig() (config, error) {
 		return config{}, err
 	}
 
+	cloudMode, err := getEnvVariable("CLOUD_MODE", "poll")
+	if err != nil {
+		return config{}, err
+	}
+
 	rawIntervalSeconds, err := getEnvVariable("INTERVAL", "10")
 	if err != nil {
 		return config{}, err
@@ -84,14 +111,49 @@ func parseConfig() (config, error) {
 		return config{}, err
 	}
 
+	rawSweepIntervalSeconds, err := getEnvVariable("SWEEP_INTERVAL", "60")
+	if err != nil {
+		return config{}, err
+	}
+
+	sweepIntervalSeconds, err := strconv.ParseInt(rawSweepIntervalSeconds, 10, 64)
+	if err != nil {
+		return config{}, fmt.Errorf("failed to parse sweep interval '%s' as integer: %w", rawSweepIntervalSeconds, err)
+	}
+
+	rawOutboxMaxAgeSeconds, err := getEnvVariable("OUTBOX_MAX_AGE", "86400")
+	if err != nil {
+		return config{}, err
+	}
+
+	outboxMaxAgeSeconds, err := strconv.ParseInt(rawOutboxMaxAgeSeconds, 10, 64)
+	if err != nil {
+		return config{}, fmt.Errorf("failed to parse outbox max age '%s' as integer: %w", rawOutboxMaxAgeSeconds, err)
+	}
+
 	return config{
 		cloudAddress:  cloudAddress,
 		cloudEndpoint: cloudEndpoint,
 		cloudUrl:      fmt.Sprintf("%s/%s", cloudAddress, cloudEndpoint),
 		cloudId:       cloudId,
 		cloudApiKey:   cloudApiKey,
+		cloudMode:     cloudMode,
 		interval:      interval,
 		serverAddress: serverAddress,
+
+		cloudClientCert: os.Getenv("CLOUD_CLIENT_CERT"),
+		cloudClientKey:  os.Getenv("CLOUD_CLIENT_KEY"),
+		cloudCABundle:   os.Getenv("CLOUD_CA_BUNDLE"),
+
+		serverTLSCert:  os.Getenv("SERVER_TLS_CERT"),
+		serverTLSKey:   os.Getenv("SERVER_TLS_KEY"),
+		serverClientCA: os.Getenv("SERVER_CLIENT_CA"),
+
+		outboxDir:           os.Getenv("OUTBOX_DIR"),
+		outboxSweepInterval: time.Second * time.Duration(sweepIntervalSeconds),
+		outboxMaxAge:        time.Second * time.Duration(outboxMaxAgeSeconds),
+
+		checksConfigPath: os.Getenv("CHECKS_CONFIG"),
 	}, nil
 }
 
@@ -108,9 +170,28 @@ func parseFormValue(name string, logger *slog.Logger, w http.ResponseWriter, r *
 	return "", false
 }
 
-func runServer(logger *slog.Logger, config *config, done <-chan bool) {
+func runServer(logger *slog.Logger, config *config, outbox *outbox, ready *readiness, checkRunner *checks.Runner, done <-chan struct{}) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+
+	registerMetricsRoutes(mux, ready)
+
+	mux.HandleFunc("/outbox/stats", func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.WithRequest(r.Context(), logger)
+
+		jsonBytes, err := json.Marshal(outbox.stats())
+		if err != nil {
+			logger.Error("error marshaling outbox stats", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonBytes)
+	})
+
+	mux.HandleFunc("/health", instrumentHandler("/health", healthRequestsTotal, func(w http.ResponseWriter, r *http.Request) {
+		logger := logging.WithRequest(r.Context(), logger)
 		logger.Debug("handling request")
 
 		if r.Method != http.MethodPost {
@@ -134,14 +215,43 @@ func runServer(logger *slog.Logger, config *config, done <-chan bool) {
 			return
 		}
 
-		repeater, didParse := parseFormValue("repeater", logger, w, r)
+		timestampRaw, didParse := parseFormValue("timestamp", logger, w, r)
 		if !didParse {
 			return
 		}
 
+		timestamp, err := strconv.ParseInt(timestampRaw, 10, 64)
+		if err != nil {
+			logger.Error("request has invalid timestamp", "timestamp", timestampRaw)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid timestamp"))
+			return
+		}
+
+		nonce, didParse := parseFormValue("nonce", logger, w, r)
+		if !didParse {
+			return
+		}
+
+		signature, didParse := parseFormValue("signature", logger, w, r)
+		if !didParse {
+			return
+		}
+
+		if !verifyAnnouncementSignature(config.cloudApiKey, cloudId, timestamp, nonce, signature, time.Now()) {
+			logger.Error("request has invalid or expired signature", "request_id", cloudId)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid or expired signature"))
+			return
+		}
+
+		results, checksOk := checkRunner.Run(r.Context())
+
 		response := &HealthResponse{
-			Repeater: repeater,
-			Id:       config.cloudId,
+			Id:     config.cloudId,
+			Checks: results,
 		}
 
 		jsonBytes, err := json.Marshal(response)
@@ -151,20 +261,37 @@ func runServer(logger *slog.Logger, config *config, done <-chan bool) {
 			return
 		}
 
-		logger.Debug("responding to valid request")
+		logger.Debug("responding to valid request", "checks_ok", checksOk)
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		if checksOk {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		w.Write(jsonBytes)
-	})
+	}))
 
-	logger.Info("starting health server", "address", config.serverAddress)
+	tlsConfig, err := loadServerTLSConfig(config.serverTLSCert, config.serverTLSKey, config.serverClientCA)
+	if err != nil {
+		logger.Error("error loading server TLS config", "err", err)
+		return
+	}
+
+	logger.Info("starting health server", "address", config.serverAddress, "tls", tlsConfig != nil)
 	server := &http.Server{
-		Handler: mux,
-		Addr:    config.serverAddress,
+		Handler:   logging.Middleware(logger, mux),
+		Addr:      config.serverAddress,
+		TLSConfig: tlsConfig,
 	}
 
 	go func() {
-		err := server.ListenAndServe()
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+
 		if errors.Is(err, http.ErrServerClosed) {
 			logger.Info("server closed")
 		} else if err != nil {
@@ -174,52 +301,28 @@ func runServer(logger *slog.Logger, config *config, done <-chan bool) {
 
 	<-done
 	logger.Info("shutting down server")
-	err := server.Shutdown(context.Background())
+	err = server.Shutdown(context.Background())
 	if err != nil {
 		logger.Error("error while shutting down server", "err", err)
 	}
 }
 
-func notifyCloud(logger *slog.Logger, config *config) {
+func notifyCloud(logger *slog.Logger, config *config, outbox *outbox, ready *readiness) {
+	nonce := rand.Text()
+	logger = logger.With("request_id", nonce)
 	logger.Debug("notifying the cloud")
 
-	v := url.Values{}
-	v.Set("id", config.cloudId)
-	v.Set("random", rand.Text())
-
-	request, err := http.NewRequestWithContext(context.Background(), http.MethodPost, config.cloudUrl, strings.NewReader(v.Encode()))
-	if err != nil {
-		logger.Error("error creating request for cloud", "error", err)
+	if deliverAnnouncement(logger, config, config.cloudId, nonce, ready) {
 		return
 	}
 
-	request.Header.Add("X-API-KEY", config.cloudApiKey)
-
-	response, err := http.DefaultClient.Do(request)
+	err := outbox.enqueue(logger, outboxEntry{
+		ID:       config.cloudId,
+		Nonce:    nonce,
+		QueuedAt: time.Now(),
+	})
 	if err != nil {
-		logger.Error("error sending request to cloud", "error", err)
-		return
-	}
-
-	if response.StatusCode == http.StatusOK {
-		return
-	}
-
-	logger.Error("unexpected status code", "status", response.Status)
-}
-
-func runTicker(logger *slog.Logger, config *config, done <-chan bool) {
-	logger.Info("setting up ticker", "interval_ms", config.interval)
-	ticker := time.NewTicker(config.interval)
-
-	for {
-		select {
-		case <-done:
-			logger.Info("logger stopped")
-			return
-		case <-ticker.C:
-			notifyCloud(logger, config)
-		}
+		logger.Error("error queuing announcement to outbox", "err", err)
 	}
 }
 
@@ -241,30 +344,60 @@ func convertLogLevel(rawLogLevel string) slog.Level {
 
 func main() {
 	rawLogLevel, _ := getEnvVariable("LOG_LEVEL", "INFO")
-	jsonHandler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
-		Level: convertLogLevel(rawLogLevel),
-	})
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(convertLogLevel(rawLogLevel))
 
-	logger := slog.New(jsonHandler)
+	handler := logging.NewLogHandler(os.Getenv("LOG_FORMAT"), logLevel)
+	bootstrapLogger := slog.New(handler)
 
 	config, err := parseConfig()
 	if err != nil {
-		logger.Error("error parsing config", "err", err)
+		bootstrapLogger.Error("error parsing config", "err", err)
+		return
+	}
+
+	cloudClient, err := cloudHTTPClient(&config)
+	if err != nil {
+		bootstrapLogger.Error("error building cloud HTTP client", "err", err)
+		return
+	}
+	config.cloudClient = cloudClient
+
+	logger := logging.BaseLogger(handler, config.cloudId, logging.NewInstanceID())
+	ready := &readiness{}
+	outbox := newOutbox(&config, ready)
+
+	checkRunner, err := checks.Load(config.checksConfigPath)
+	if err != nil {
+		logger.Error("error loading checks config", "err", err)
 		return
 	}
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	done := make(chan bool, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rawLogLevel, _ := getEnvVariable("LOG_LEVEL", "INFO")
+			logLevel.Set(convertLogLevel(rawLogLevel))
+			logger.Info("reloaded log level", "log_level", rawLogLevel)
+		}
+	}()
+
+	done := make(chan struct{})
 
 	go func() {
 		sig := <-signals
 		logger.Info("received signal", "signal", sig)
-		done <- true
+		close(done)
 	}()
 
-	go runServer(logger, &config, done)
-	go runTicker(logger, &config, done)
+	notifier := newNotifier(logger, &config, outbox, ready)
+
+	go runServer(logger, &config, outbox, ready, checkRunner, done)
+	go notifier.Run(done)
+	go outbox.run(logger, done)
 	<-done
 }
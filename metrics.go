@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	announcementsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_announcements_total",
+		Help: "Total number of cloud announcements, by result.",
+	}, []string{"result"})
+
+	healthRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_health_requests_total",
+		Help: "Total number of /health requests handled, by result.",
+	}, []string{"result"})
+
+	announcementLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "agent_announcement_latency_seconds",
+		Help: "Round-trip latency of cloud announcement requests.",
+	})
+
+	handlerLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "agent_handler_latency_seconds",
+		Help: "Latency of HTTP handlers, by path.",
+	}, []string{"path"})
+
+	outboxPendingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "agent_outbox_pending",
+		Help: "Number of announcements currently queued in the outbox.",
+	})
+
+	lastSuccessTimestampGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "agent_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the most recent successful announcement.",
+	})
+)
+
+// statusClass buckets an HTTP status code into the coarse "2xx"/"4xx"/"5xx"
+// style label used on metrics, falling back to "error" for anything sent
+// without a status (e.g. a transport-level failure).
+func statusClass(code int) string {
+	if code == 0 {
+		return "error"
+	}
+
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// readiness tracks whether the agent has ever announced successfully, so
+// /ready can gate orchestrator traffic until the cloud channel is known to
+// work.
+type readiness struct {
+	ready atomic.Bool
+}
+
+func (r *readiness) markReady() {
+	r.ready.Store(true)
+	lastSuccessTimestampGauge.Set(float64(time.Now().Unix()))
+}
+
+func (r *readiness) isReady() bool {
+	return r.ready.Load()
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code
+// written, so middleware can label metrics after the handler returns.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentHandler times calls to next and records handlerLatency and a
+// result-labelled counter under path.
+func instrumentHandler(path string, counter *prometheus.CounterVec, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next(recorder, r)
+
+		handlerLatency.WithLabelValues(path).Observe(time.Since(start).Seconds())
+		counter.WithLabelValues(statusClass(recorder.status)).Inc()
+	}
+}
+
+// registerMetricsRoutes adds /metrics and /ready to mux.
+func registerMetricsRoutes(mux *http.ServeMux, ready *readiness) {
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
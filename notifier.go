@@ -0,0 +1,278 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/is-my-homelab-up/agent/logging"
+)
+
+// wsReconnectBaseBackoff is the delay before the first reconnect attempt
+// after a dropped WebSocket connection; it doubles (capped at
+// wsReconnectMaxBackoff) on each subsequent failure and is jittered to
+// avoid a reconnect thundering herd.
+const wsReconnectBaseBackoff = 1 * time.Second
+
+// wsReconnectMaxBackoff caps the reconnect backoff.
+const wsReconnectMaxBackoff = 2 * time.Minute
+
+// wsReconnectResetAfter is how long a connection has to stay up before a
+// subsequent drop is treated as a fresh failure (backoff restarting from
+// wsReconnectBaseBackoff) rather than another in a run of consecutive
+// ones; without this, a connection that's been stable for days would
+// still back off at wsReconnectMaxBackoff after a single one-off blip.
+const wsReconnectResetAfter = 2 * time.Minute
+
+// wsPingInterval is how often writePump sends a WebSocket ping control
+// frame to detect a dead connection that would otherwise block readPump's
+// ReadJSON forever.
+const wsPingInterval = 30 * time.Second
+
+// wsPongWait is how long readPump waits for a pong before considering the
+// connection dead; the read deadline is set once on connect and refreshed
+// only by every pong received.
+const wsPongWait = 60 * time.Second
+
+// Notifier announces this agent's health to the cloud, either on a fixed
+// interval (pollNotifier) or over a persistent push channel (wsNotifier).
+// runTicker's original body lives on as pollNotifier.Run.
+type Notifier interface {
+	Run(done <-chan struct{})
+}
+
+// newNotifier selects the transport named by config.cloudMode ("poll", the
+// default, or "ws").
+func newNotifier(logger *slog.Logger, config *config, outbox *outbox, ready *readiness) Notifier {
+	if config.cloudMode == "ws" {
+		return &wsNotifier{logger: logger, config: config, outbox: outbox, ready: ready}
+	}
+
+	return &pollNotifier{logger: logger, config: config, outbox: outbox, ready: ready}
+}
+
+// pollNotifier is the original fixed-interval HTTP POST transport.
+type pollNotifier struct {
+	logger *slog.Logger
+	config *config
+	outbox *outbox
+	ready  *readiness
+}
+
+func (n *pollNotifier) Run(done <-chan struct{}) {
+	n.logger.Info("setting up ticker", "interval_ms", n.config.interval)
+	ticker := time.NewTicker(n.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			n.logger.Info("logger stopped")
+			return
+		case <-ticker.C:
+			notifyCloud(n.logger, n.config, n.outbox, n.ready)
+		}
+	}
+}
+
+// wsNotifier keeps a persistent WebSocket open to the cloud's /v1/stream
+// endpoint, sending periodic "alive" keepalives and reacting to
+// server-pushed commands, reconnecting with jittered backoff on drop.
+type wsNotifier struct {
+	logger *slog.Logger
+	config *config
+	outbox *outbox
+	ready  *readiness
+}
+
+func (n *wsNotifier) Run(done <-chan struct{}) {
+	attempt := 0
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		connectedAt := time.Now()
+		if err := n.connectAndServe(done); err != nil {
+			n.logger.Error("websocket connection failed", "err", err, "attempt", attempt)
+		}
+
+		if time.Since(connectedAt) >= wsReconnectResetAfter {
+			attempt = 0
+		}
+
+		attempt++
+		backoff := jitteredBackoff(wsReconnectBaseBackoff, wsReconnectMaxBackoff, attempt)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (n *wsNotifier) streamURL() string {
+	url := strings.Replace(n.config.cloudAddress, "https://", "wss://", 1)
+	url = strings.Replace(url, "http://", "ws://", 1)
+	return url + "/v1/stream"
+}
+
+func (n *wsNotifier) connectAndServe(done <-chan struct{}) error {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+
+	tlsConfig, err := loadClientTLSConfig(n.config.cloudClientCert, n.config.cloudClientKey, n.config.cloudCABundle)
+	if err != nil {
+		return err
+	}
+	dialer.TLSClientConfig = tlsConfig
+
+	header := http.Header{}
+	header.Add("X-API-KEY", n.config.cloudApiKey)
+
+	conn, _, err := dialer.Dial(n.streamURL(), header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	n.logger.Info("websocket connected", "url", n.streamURL())
+
+	if err := n.sendAuthFrame(conn); err != nil {
+		return err
+	}
+
+	outbound := make(chan []byte, 16)
+	readerDone := make(chan struct{})
+
+	// readPump blocks on conn.ReadJSON until the next message, the read
+	// deadline, or the socket closing; a write-side close frame alone doesn't
+	// unblock it, so close the connection directly as soon as done fires.
+	go func() {
+		select {
+		case <-done:
+			conn.Close()
+		case <-readerDone:
+		}
+	}()
+
+	go n.writePump(conn, outbound, done, readerDone)
+	return n.readPump(conn, outbound, readerDone)
+}
+
+// sendAuthFrame sends the initial signed-credentials frame the cloud uses
+// to authenticate the stream.
+func (n *wsNotifier) sendAuthFrame(conn *websocket.Conn) error {
+	timestamp := time.Now().Unix()
+	nonce := randomNonce()
+	signature := signAnnouncement(n.config.cloudApiKey, n.config.cloudId, timestamp, nonce)
+
+	frame := map[string]string{
+		"type":      "auth",
+		"id":        n.config.cloudId,
+		"timestamp": strconv.FormatInt(timestamp, 10),
+		"nonce":     nonce,
+		"signature": signature,
+	}
+
+	return conn.WriteJSON(frame)
+}
+
+// writePump sends periodic "alive" keepalives and WebSocket pings, and
+// relays anything queued on outbound, until done fires or the reader
+// signals the connection died.
+func (n *wsNotifier) writePump(conn *websocket.Conn, outbound <-chan []byte, done <-chan struct{}, readerDone <-chan struct{}) {
+	ticker := time.NewTicker(n.config.interval)
+	defer ticker.Stop()
+
+	pingTicker := time.NewTicker(wsPingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case <-readerDone:
+			return
+		case <-done:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case <-pingTicker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				n.logger.Error("error sending ping", "err", err)
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteJSON(map[string]string{"type": "alive"}); err != nil {
+				n.logger.Error("error sending keepalive", "err", err)
+				return
+			}
+		case message := <-outbound:
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				n.logger.Error("error writing to websocket", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// readPump blocks reading server-pushed commands until the connection
+// drops, handling ping/pong and dispatching recognized commands.
+func (n *wsNotifier) readPump(conn *websocket.Conn, outbound chan<- []byte, readerDone chan<- struct{}) error {
+	defer close(readerDone)
+
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	if err := conn.SetReadDeadline(time.Now().Add(wsPongWait)); err != nil {
+		return err
+	}
+
+	for {
+		var command struct {
+			Command string `json:"command"`
+		}
+
+		if err := conn.ReadJSON(&command); err != nil {
+			return err
+		}
+
+		n.logger.Debug("received command from cloud", "command", command.Command)
+
+		switch command.Command {
+		case "announce-now":
+			notifyCloud(n.logger, n.config, n.outbox, n.ready)
+		case "reload-config":
+			n.logger.Info("reload-config command received; log level reload is supported via SIGHUP")
+		case "shutdown":
+			n.logger.Info("shutdown command received from cloud")
+			return nil
+		default:
+			n.logger.Error("received unknown command from cloud", "command", command.Command)
+		}
+	}
+}
+
+func randomNonce() string {
+	return logging.NewInstanceID()
+}
+
+// jitteredBackoff computes an exponential backoff for the given attempt
+// (1-indexed), capped at max and jittered by up to 50% to avoid every
+// client reconnecting in lockstep.
+func jitteredBackoff(base, max time.Duration, attempt int) time.Duration {
+	backoff := base * time.Duration(1<<uint(attempt))
+	if backoff > max || backoff <= 0 {
+		backoff = max
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+	return backoff/2 + jitter
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/is-my-homelab-up/agent/logging"
+)
+
+// outboxWorkers bounds how many queued announcements the sweeper retries
+// concurrently.
+const outboxWorkers = 4
+
+// outboxBaseBackoff is the delay before the first retry of a queued
+// announcement; it doubles (capped at outboxMaxBackoff) on each subsequent
+// failure.
+const outboxBaseBackoff = 5 * time.Second
+
+// outboxMaxBackoff caps the exponential backoff applied between retries.
+const outboxMaxBackoff = 10 * time.Minute
+
+// outboxEntry is the on-disk, crash-safe record of an announcement that
+// failed to deliver and is queued for re-delivery.
+type outboxEntry struct {
+	ID          string    `json:"id"`
+	Nonce       string    `json:"nonce"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// outboxStats is the shape returned by the /outbox/stats endpoint.
+type outboxStats struct {
+	Pending            int       `json:"pending"`
+	OldestEntryAgeSecs float64   `json:"oldest_entry_age_seconds"`
+	LastSuccess        time.Time `json:"last_success"`
+}
+
+// outbox persists announcements that notifyCloud failed to deliver to
+// OUTBOX_DIR, and periodically retries them with exponential backoff until
+// they succeed or age past maxAge.
+type outbox struct {
+	dir           string
+	sweepInterval time.Duration
+	maxAge        time.Duration
+	config        *config
+	ready         *readiness
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+}
+
+// newOutbox builds an outbox rooted at config.outboxDir; a zero-value dir
+// disables the subsystem.
+func newOutbox(config *config, ready *readiness) *outbox {
+	return &outbox{
+		dir:           config.outboxDir,
+		sweepInterval: config.outboxSweepInterval,
+		maxAge:        config.outboxMaxAge,
+		config:        config,
+		ready:         ready,
+	}
+}
+
+func (o *outbox) enabled() bool {
+	return len(o.dir) != 0
+}
+
+// enqueue persists entry to disk so it survives a restart, writing to a
+// temp file, fsync'ing, and renaming into place so an unclean shutdown
+// never leaves a half-written entry behind.
+func (o *outbox) enqueue(logger *slog.Logger, entry outboxEntry) error {
+	if !o.enabled() {
+		return nil
+	}
+
+	if err := os.MkdirAll(o.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create outbox dir '%s': %w", o.dir, err)
+	}
+
+	if err := o.writeEntry(entry); err != nil {
+		return err
+	}
+
+	logger.Info("queued announcement to outbox", "id", entry.ID, "nonce", entry.Nonce)
+	outboxPendingGauge.Set(float64(o.pendingCount()))
+	return nil
+}
+
+func (o *outbox) entryPath(nonce string) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%s.json", nonce))
+}
+
+func (o *outbox) writeEntry(entry outboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox entry: %w", err)
+	}
+
+	finalPath := o.entryPath(entry.Nonce)
+	tmpPath := filepath.Join(o.dir, fmt.Sprintf(".%s.tmp", entry.Nonce))
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox temp file '%s': %w", tmpPath, err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write outbox temp file '%s': %w", tmpPath, err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to fsync outbox temp file '%s': %w", tmpPath, err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close outbox temp file '%s': %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename outbox entry into place '%s': %w", finalPath, err)
+	}
+
+	return nil
+}
+
+// run sweeps the outbox directory on sweepInterval until done fires,
+// retrying each pending entry that is due and dropping entries older than
+// maxAge.
+func (o *outbox) run(logger *slog.Logger, done <-chan struct{}) {
+	if !o.enabled() {
+		return
+	}
+
+	logger.Info("starting outbox sweeper", "dir", o.dir, "sweep_interval", o.sweepInterval)
+	ticker := time.NewTicker(o.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			o.sweep(logger)
+		}
+	}
+}
+
+func (o *outbox) sweep(logger *slog.Logger) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		logger.Error("error reading outbox dir", "err", err)
+		return
+	}
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+
+	for i := 0; i < outboxWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				o.retry(logger, path)
+			}
+		}()
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		paths <- filepath.Join(o.dir, file.Name())
+	}
+
+	close(paths)
+	wg.Wait()
+
+	outboxPendingGauge.Set(float64(o.pendingCount()))
+}
+
+func (o *outbox) pendingCount() int {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		count++
+	}
+
+	return count
+}
+
+func (o *outbox) retry(logger *slog.Logger, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("error reading outbox entry", "path", path, "err", err)
+		return
+	}
+
+	var entry outboxEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logger.Error("error parsing outbox entry, dropping", "path", path, "err", err)
+		os.Remove(path)
+		return
+	}
+
+	if time.Since(entry.QueuedAt) > o.maxAge {
+		logger.Error("dropping outbox entry past max age", "id", entry.ID, "queued_at", entry.QueuedAt)
+		os.Remove(path)
+		return
+	}
+
+	if time.Now().Before(entry.NextAttempt) {
+		return
+	}
+
+	logger = logger.With("request_id", entry.Nonce)
+	if deliverAnnouncement(logger, o.config, entry.ID, entry.Nonce, o.ready) {
+		o.mu.Lock()
+		o.lastSuccess = time.Now()
+		o.mu.Unlock()
+
+		logger.Info("delivered queued announcement", "id", entry.ID)
+		os.Remove(path)
+		return
+	}
+
+	entry.Attempts++
+	entry.NextAttempt = time.Now().Add(backoffFor(entry.Attempts))
+	if err := o.writeEntry(entry); err != nil {
+		logger.Error("error updating outbox entry", "path", path, "err", err)
+	}
+}
+
+func backoffFor(attempts int) time.Duration {
+	backoff := outboxBaseBackoff * time.Duration(1<<(attempts-1))
+	if backoff > outboxMaxBackoff || backoff <= 0 {
+		return outboxMaxBackoff
+	}
+
+	return backoff
+}
+
+// stats reports the current outbox depth and oldest pending entry for the
+// /outbox/stats endpoint.
+func (o *outbox) stats() outboxStats {
+	o.mu.Lock()
+	lastSuccess := o.lastSuccess
+	o.mu.Unlock()
+
+	stats := outboxStats{LastSuccess: lastSuccess}
+
+	if !o.enabled() {
+		return stats
+	}
+
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return stats
+	}
+
+	var oldest time.Time
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		stats.Pending++
+
+		data, err := os.ReadFile(filepath.Join(o.dir, file.Name()))
+		if err != nil {
+			continue
+		}
+
+		var entry outboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+
+		if oldest.IsZero() || entry.QueuedAt.Before(oldest) {
+			oldest = entry.QueuedAt
+		}
+	}
+
+	if !oldest.IsZero() {
+		stats.OldestEntryAgeSecs = time.Since(oldest).Seconds()
+	}
+
+	return stats
+}
+
+// deliverAnnouncement signs and sends an announcement for id directly to
+// the cloud, bypassing the outbox; used both by the initial send and by
+// outbox retries. nonce must be the same nonce the caller already tagged
+// its logger with, so the X-Request-ID sent to the cloud matches the
+// request_id on every log line for this attempt. It reports whether
+// delivery succeeded.
+func deliverAnnouncement(logger *slog.Logger, config *config, id string, nonce string, ready *readiness) bool {
+	timestamp := time.Now().Unix()
+	signature := signAnnouncement(config.cloudApiKey, id, timestamp, nonce)
+
+	v := url.Values{}
+	v.Set("id", id)
+	v.Set("timestamp", strconv.FormatInt(timestamp, 10))
+	v.Set("nonce", nonce)
+	v.Set("signature", signature)
+
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodPost, config.cloudUrl, strings.NewReader(v.Encode()))
+	if err != nil {
+		logger.Error("error creating request for cloud", "error", err)
+		announcementsTotal.WithLabelValues("error").Inc()
+		return false
+	}
+
+	request.Header.Add("X-API-KEY", config.cloudApiKey)
+	request.Header.Add(logging.RequestIDHeader, nonce)
+
+	start := time.Now()
+	response, err := config.cloudClient.Do(request)
+	announcementLatency.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		logger.Error("error sending request to cloud", "error", err)
+		announcementsTotal.WithLabelValues("error").Inc()
+		return false
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode == http.StatusOK {
+		announcementsTotal.WithLabelValues("ok").Inc()
+		ready.markReady()
+		return true
+	}
+
+	logger.Error("unexpected status code", "status", response.Status)
+	announcementsTotal.WithLabelValues("error").Inc()
+	return false
+}